@@ -0,0 +1,78 @@
+// exchange_payload_types.go is a hand-maintained Go counterpart to
+// exchange_payload.proto. It is NOT produced by protoc and must not be
+// confused with real protoc-gen-go output: its legacy-reflection shape
+// (struct tags plus Reset/String/ProtoMessage) is only enough to satisfy
+// github.com/golang/protobuf/proto's Marshal/Unmarshal, not the full
+// protoreflect API a current protoc-gen-go would emit. If exchange_payload.proto
+// changes, update this file to match by hand, in the same commit; if this
+// package ever gains a protoc build step, this file should be deleted and
+// replaced with real generated output rather than kept alongside it.
+
+package protocol
+
+import (
+	fmt "fmt"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+
+// ExchangePayloadV2 is the versioned replacement for the original,
+// unversioned JSON client-to-client exchange payload. See
+// exchange_payload.proto for field documentation.
+type ExchangePayloadV2 struct {
+	Version                 uint32   `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	MinReaderVersion        uint32   `protobuf:"varint,2,opt,name=min_reader_version,json=minReaderVersion,proto3" json:"min_reader_version,omitempty"`
+	ServerEntries           [][]byte `protobuf:"bytes,3,rep,name=server_entries,json=serverEntries,proto3" json:"server_entries,omitempty"`
+	ExchangedDialParameters [][]byte `protobuf:"bytes,4,rep,name=exchanged_dial_parameters,json=exchangedDialParameters,proto3" json:"exchanged_dial_parameters,omitempty"`
+	ExtensionData           []byte   `protobuf:"bytes,5,opt,name=extension_data,json=extensionData,proto3" json:"extension_data,omitempty"`
+	XXX_NoUnkeyedLiteral    struct{} `json:"-"`
+	XXX_unrecognized        []byte   `json:"-"`
+	XXX_sizecache           int32    `json:"-"`
+}
+
+func (m *ExchangePayloadV2) Reset()         { *m = ExchangePayloadV2{} }
+func (m *ExchangePayloadV2) String() string { return proto.CompactTextString(m) }
+func (*ExchangePayloadV2) ProtoMessage()    {}
+
+func (m *ExchangePayloadV2) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *ExchangePayloadV2) GetMinReaderVersion() uint32 {
+	if m != nil {
+		return m.MinReaderVersion
+	}
+	return 0
+}
+
+func (m *ExchangePayloadV2) GetServerEntries() [][]byte {
+	if m != nil {
+		return m.ServerEntries
+	}
+	return nil
+}
+
+func (m *ExchangePayloadV2) GetExchangedDialParameters() [][]byte {
+	if m != nil {
+		return m.ExchangedDialParameters
+	}
+	return nil
+}
+
+func (m *ExchangePayloadV2) GetExtensionData() []byte {
+	if m != nil {
+		return m.ExtensionData
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*ExchangePayloadV2)(nil), "protocol.ExchangePayloadV2")
+}
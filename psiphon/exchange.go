@@ -21,7 +21,6 @@ package psiphon
 
 import (
 	"encoding/base64"
-	"encoding/json"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/secretbox"
@@ -73,6 +72,12 @@ import (
 //
 // The return value is a payload that may be exchanged with another client;
 // when "", the export failed and a diagnostic notice has been logged.
+//
+// Since the payload is obfuscated with the long-lived ExchangeObfuscationKey,
+// compromise of that key -- present in every client -- compromises every
+// past and future exchange. Where forward secrecy is required, use
+// NewExchangeInvitation, ExportExchangePayloadForInvitation, and
+// CompleteExchangeImport instead.
 func ExportExchangePayload(config *Config) string {
 	payload, err := exportExchangePayload(config)
 	if err != nil {
@@ -94,15 +99,24 @@ func ExportExchangePayload(config *Config) string {
 // ExchangedDialParameters, the exchange dial parameters includes only the
 // most broadly applicable fields.
 //
-// The return value indicates a successful import. If the import failed, a
-// a diagnostic notice has been logged.
-func ImportExchangePayload(config *Config, encodedPayload string) bool {
+// A payload that has already been presented for import once, within the
+// replay filter's retention window, is rejected with ExchangeReplayError,
+// distinguishing a replayed import from a decrypt or verification failure;
+// ImportExchangePayload returns this error, rather than only logging it, so
+// that a host app can distinguish the two cases. The payload is recorded in
+// the replay filter before it is decrypted, so a repeat is rejected this way
+// whether or not the earlier attempt succeeded.
+//
+// The first return value indicates a successful import. If the import
+// failed, the error is also returned, in addition to a diagnostic notice
+// having been logged.
+func ImportExchangePayload(config *Config, encodedPayload string) (bool, error) {
 	err := importExchangePayload(config, encodedPayload)
 	if err != nil {
 		NoticeWarning("ImportExchangePayload failed: %s", errors.Trace(err))
-		return false
+		return false, errors.Trace(err)
 	}
-	return true
+	return true, nil
 }
 
 type exchangePayload struct {
@@ -119,17 +133,35 @@ func exportExchangePayload(config *Config) (string, error) {
 		return "", errors.Trace(err)
 	}
 
+	payload, err := makeExchangePayload(networkID)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	payloadBytes, err := encodeExchangePayloadV2(payload)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return sealExchangeBlob(key, payloadBytes)
+}
+
+// makeExchangePayload gathers the affinity server entry and dial parameters
+// for networkID into an exchangePayload, ready to be marshaled and sealed by
+// any of the export variants.
+func makeExchangePayload(networkID string) (*exchangePayload, error) {
+
 	serverEntryFields, dialParams, err :=
 		GetAffinityServerEntryAndDialParameters(networkID)
 	if err != nil {
-		return "", errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
 	// Fail if the server entry has no signature, as the exchange would be
 	// insecure. Given the mechanism where handshake will return a signed server
 	// entry to clients without one, this case is not expected to occur.
 	if !serverEntryFields.HasSignature() {
-		return "", errors.TraceNew("export server entry not signed")
+		return nil, errors.TraceNew("export server entry not signed")
 	}
 
 	// RemoveUnsignedFields also removes potentially sensitive local fields, so
@@ -141,32 +173,10 @@ func exportExchangePayload(config *Config) (string, error) {
 		exchangedDialParameters = NewExchangedDialParameters(dialParams)
 	}
 
-	payload := &exchangePayload{
+	return &exchangePayload{
 		ServerEntryFields:       serverEntryFields,
 		ExchangedDialParameters: exchangedDialParameters,
-	}
-
-	payloadJSON, err := json.Marshal(payload)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	// A unique nonce is generated and included with the payload as the
-	// obfuscation keys is not single-use.
-	nonce, err := common.MakeSecureRandomBytes(24)
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-
-	var secretboxNonce [24]byte
-	copy(secretboxNonce[:], nonce)
-	var secretboxKey [32]byte
-	copy(secretboxKey[:], key)
-	boxedPayload := secretbox.Seal(
-		nil, payloadJSON, &secretboxNonce, &secretboxKey)
-	boxedPayload = append(secretboxNonce[:], boxedPayload...)
-
-	return base64.StdEncoding.EncodeToString(boxedPayload), nil
+	}, nil
 }
 
 func importExchangePayload(config *Config, encodedPayload string) error {
@@ -178,7 +188,7 @@ func importExchangePayload(config *Config, encodedPayload string) error {
 		return errors.Trace(err)
 	}
 
-	boxedPayload, err := base64.StdEncoding.DecodeString(encodedPayload)
+	boxedPayload, err := decodeExchangeBytes(encodedPayload)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -187,27 +197,48 @@ func importExchangePayload(config *Config, encodedPayload string) error {
 		return errors.TraceNew("unexpected box length")
 	}
 
-	var secretboxNonce [24]byte
-	copy(secretboxNonce[:], boxedPayload[:24])
-	var secretboxKey [32]byte
-	copy(secretboxKey[:], key)
-	payloadJSON, ok := secretbox.Open(
-		nil, boxedPayload[24:], &secretboxNonce, &secretboxKey)
-	if !ok {
-		return errors.TraceNew("unbox failed")
+	secretboxNonce := boxedPayload[:24]
+	box := boxedPayload[24:]
+
+	// Reject payloads that have already been imported before attempting to
+	// decrypt them, so a stale bundle cannot be used to repeatedly pin a user
+	// to a burned server or to correlate imports across networks.
+	seen, err := checkAndInsertExchangeReplay(config, secretboxNonce, box)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if seen {
+		return errors.Trace(ErrExchangeReplay)
+	}
+
+	plaintext, err := openSealedExchangeBox(key, secretboxNonce, box)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	var payload *exchangePayload
-	err = json.Unmarshal(payloadJSON, &payload)
+	payload, err := decodeExchangePayload(plaintext)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	return importExchangePayloadContent(config, networkID, payload, true)
+}
+
+// importExchangePayloadContent applies a decoded exchangePayload to the
+// local datastore: it is the common tail shared by importExchangePayload,
+// completeExchangeImport, and the batch import path, all of which differ
+// only in how they obtain and authenticate the payload. When promote is
+// false, the server entry is stored but not moved into the affinity
+// position, which is used by the batch import path to promote only the
+// first successfully imported entry.
+func importExchangePayloadContent(
+	config *Config, networkID string, payload *exchangePayload, promote bool) error {
+
 	// Explicitly strip any unsigned fields that should not be exchanged or
 	// imported.
 	payload.ServerEntryFields.RemoveUnsignedFields()
 
-	err = payload.ServerEntryFields.VerifySignature(
+	err := payload.ServerEntryFields.VerifySignature(
 		config.ServerEntrySignaturePublicKey)
 	if err != nil {
 		return errors.Trace(err)
@@ -231,9 +262,11 @@ func importExchangePayload(config *Config, encodedPayload string) error {
 		return errors.Trace(err)
 	}
 
-	err = PromoteServerEntry(config, payload.ServerEntryFields.GetIPAddress())
-	if err != nil {
-		return errors.Trace(err)
+	if promote {
+		err = PromoteServerEntry(config, payload.ServerEntryFields.GetIPAddress())
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 
 	if payload.ExchangedDialParameters != nil {
@@ -280,3 +313,79 @@ func getExchangeObfuscationKey(config *Config) ([]byte, error) {
 	}
 	return key, nil
 }
+
+// sealExchangeBlob obfuscates plaintext with a fresh nonce under key,
+// producing the "nonce || box" encoding used by ExportExchangePayload, the
+// batch export, and the invitation and secretHandle of NewExchangeInvitation.
+// The response of ExportExchangePayloadForInvitation is not sealed this way.
+func sealExchangeBlob(key []byte, plaintext []byte) (string, error) {
+
+	// A unique nonce is generated and included with the payload as the
+	// obfuscation key is not single-use.
+	nonce, err := common.MakeSecureRandomBytes(24)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var secretboxNonce [24]byte
+	copy(secretboxNonce[:], nonce)
+	var secretboxKey [32]byte
+	copy(secretboxKey[:], key)
+
+	boxedPayload := secretboxSeal(plaintext, &secretboxNonce, &secretboxKey)
+	boxedPayload = append(secretboxNonce[:], boxedPayload...)
+
+	return encodeExchangeBytes(boxedPayload), nil
+}
+
+// openExchangeBlob reverses sealExchangeBlob.
+func openExchangeBlob(key []byte, encoded string) ([]byte, error) {
+
+	boxedPayload, err := decodeExchangeBytes(encoded)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(boxedPayload) <= 24 {
+		return nil, errors.TraceNew("unexpected box length")
+	}
+
+	return openSealedExchangeBox(key, boxedPayload[:24], boxedPayload[24:])
+}
+
+// openSealedExchangeBox opens a secretbox given an already-split
+// secretboxNonce and box, as produced by sealExchangeBlob.
+func openSealedExchangeBox(key []byte, secretboxNonce []byte, box []byte) ([]byte, error) {
+
+	var nonce [24]byte
+	copy(nonce[:], secretboxNonce)
+	var secretboxKey [32]byte
+	copy(secretboxKey[:], key)
+
+	plaintext, ok := secretboxOpen(box, &nonce, &secretboxKey)
+	if !ok {
+		return nil, errors.TraceNew("unbox failed")
+	}
+
+	return plaintext, nil
+}
+
+func secretboxSeal(plaintext []byte, nonce *[24]byte, key *[32]byte) []byte {
+	return secretbox.Seal(nil, plaintext, nonce, key)
+}
+
+func secretboxOpen(box []byte, nonce *[24]byte, key *[32]byte) ([]byte, bool) {
+	return secretbox.Open(nil, box, nonce, key)
+}
+
+func encodeExchangeBytes(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func decodeExchangeBytes(encoded string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return data, nil
+}
@@ -0,0 +1,435 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/google/uuid"
+)
+
+// exchangeBatchChunkPrefix identifies a chunk produced by
+// ExportExchangePayloadBatch. Chunks are formatted as
+// "psi1:<uuid>:<i>/<n>:<base64>" so that a scanner can recognize a partial
+// scan -- for example, a QR code from the wrong batch, or one already
+// scanned -- without first trying to decode it.
+const exchangeBatchChunkPrefix = "psi1"
+
+// exchangeBatchChunkDataSize is the approximate number of base64 characters
+// placed in each chunk. It's chosen to keep the per-chunk payload small
+// enough to render as a reasonably dense QR code or fit in a single NFC
+// burst.
+const exchangeBatchChunkDataSize = 800
+
+// exchangeBatchChunkMaxDataSize bounds the size of a single chunk's data
+// field accepted by importExchangePayloadChunk. It's set well above
+// exchangeBatchChunkDataSize, the size this client itself produces, since a
+// chunk may originate from a different client build; it exists only to
+// reject chunks too large to be a legitimate sideloaded fragment before any
+// is buffered.
+const exchangeBatchChunkMaxDataSize = 65536
+
+// exchangeBatchMaxPendingBatches bounds the number of distinct, incomplete
+// batches buffered concurrently, so a flood of chunks from bogus or
+// never-completed batch IDs cannot grow exchangeBatchChunks without limit.
+const exchangeBatchMaxPendingBatches = 16
+
+// exchangeBatchMaxBufferedBytes bounds the total bytes buffered for a single
+// pending batch, independent of the total chunk count the batch claims,
+// since that count is taken from unauthenticated, attacker-controlled input.
+const exchangeBatchMaxBufferedBytes = 1 << 20
+
+// exchangeBatchPendingTTL bounds how long a batch may remain incomplete,
+// buffered, and counted against exchangeBatchMaxPendingBatches, before it's
+// dropped by the next call to bufferExchangeBatchChunk. There's no
+// background sweep: pending batches are cheap enough, and infrequent enough,
+// that sweeping opportunistically, on the next insert, is sufficient.
+const exchangeBatchPendingTTL = 10 * time.Minute
+
+type exchangeBatchEntry struct {
+	ServerEntryFields       protocol.ServerEntryFields
+	ExchangedDialParameters *ExchangedDialParameters
+}
+
+type exchangePayloadBatch struct {
+	Entries []exchangeBatchEntry
+}
+
+// ExportExchangePayloadBatch creates a batch exchange payload carrying up to
+// maxEntries of the current network's top affinity server entry candidates,
+// along with their dial parameters, and splits the result into a sequence
+// of self-describing chunks suitable for sideloading between devices over
+// several QR codes or NFC bursts.
+//
+// Each returned chunk should be passed, in any order and from any source, to
+// ImportExchangePayloadChunk on the receiving device. The batch is imported
+// only once every chunk has arrived, and, as the whole batch is sealed as a
+// single box, a corrupted chunk causes the entire batch to fail to open.
+//
+// As with ExportExchangePayload, the batch is obfuscated with the
+// ExchangeObfuscationKey embedded in clients.
+//
+// Unlike ExportExchangePayload, ExportExchangePayloadBatch returns its error
+// rather than logging and discarding it: the caller, not this package, is
+// best placed to decide whether a failed batch export -- for example, one
+// with no affinity server entries to offer yet -- is worth surfacing to the
+// user.
+func ExportExchangePayloadBatch(config *Config, maxEntries int) ([]string, error) {
+	chunks, err := exportExchangePayloadBatch(config, maxEntries)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return chunks, nil
+}
+
+// ImportExchangePayloadChunk buffers one chunk produced by
+// ExportExchangePayloadBatch. Once every chunk of a batch has been received,
+// the batch is decrypted and imported: each server entry's signature is
+// verified independently, and any entry that fails verification is skipped,
+// with a warning notice, rather than aborting the whole batch. This skip
+// applies to entries that decrypt but fail signature verification: the batch
+// is sealed as a single box, so corruption of any chunk's data fails the
+// import of every entry. Only the first successfully imported entry is
+// promoted to the affinity position, preserving the semantics of
+// ImportExchangePayload.
+//
+// The first return value is true only when this chunk completed its batch
+// and the batch was imported; when the batch completed but its import
+// failed, it is false and the error is returned.
+//
+// Unlike ImportExchangePayload, ImportExchangePayloadChunk returns its error
+// rather than logging and discarding it, matching ExportExchangePayloadBatch:
+// a caller accumulating chunks from an unreliable source, such as a flaky QR
+// scan, needs to distinguish a malformed chunk from one it simply hasn't
+// seen yet, rather than learning of the failure only through a log notice.
+func ImportExchangePayloadChunk(config *Config, chunk string) (bool, error) {
+	complete, err := importExchangePayloadChunk(config, chunk)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return complete, nil
+}
+
+func exportExchangePayloadBatch(config *Config, maxEntries int) ([]string, error) {
+
+	networkID := config.GetNetworkID()
+
+	key, err := getExchangeObfuscationKey(config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	serverEntryFieldsList, dialParamsList, err :=
+		GetAffinityServerEntriesAndDialParameters(networkID, maxEntries)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	entries := make([]exchangeBatchEntry, 0, len(serverEntryFieldsList))
+	for i, serverEntryFields := range serverEntryFieldsList {
+
+		// As with exportExchangePayload, only signed server entries may be
+		// exchanged.
+		if !serverEntryFields.HasSignature() {
+			continue
+		}
+
+		serverEntryFields.RemoveUnsignedFields()
+
+		var exchangedDialParameters *ExchangedDialParameters
+		if dialParamsList[i] != nil {
+			exchangedDialParameters = NewExchangedDialParameters(dialParamsList[i])
+		}
+
+		entries = append(entries, exchangeBatchEntry{
+			ServerEntryFields:       serverEntryFields,
+			ExchangedDialParameters: exchangedDialParameters,
+		})
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.TraceNew("no signed server entries available")
+	}
+
+	batchJSON, err := json.Marshal(&exchangePayloadBatch{Entries: entries})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	encodedBatch, err := sealExchangeBlob(key, batchJSON)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return chunkExchangeBatch(encodedBatch), nil
+}
+
+func chunkExchangeBatch(encodedBatch string) []string {
+
+	n := (len(encodedBatch) + exchangeBatchChunkDataSize - 1) / exchangeBatchChunkDataSize
+	if n == 0 {
+		n = 1
+	}
+
+	batchID := uuid.New().String()
+
+	chunks := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		start := i * exchangeBatchChunkDataSize
+		end := start + exchangeBatchChunkDataSize
+		if end > len(encodedBatch) {
+			end = len(encodedBatch)
+		}
+		chunks = append(chunks, fmt.Sprintf(
+			"%s:%s:%d/%d:%s",
+			exchangeBatchChunkPrefix, batchID, i+1, n, encodedBatch[start:end]))
+	}
+
+	return chunks
+}
+
+type exchangeBatchChunkBuffer struct {
+	total         int
+	received      map[int]string
+	bytesBuffered int
+	createdAt     time.Time
+}
+
+var exchangeBatchChunksMutex sync.Mutex
+var exchangeBatchChunks = make(map[string]*exchangeBatchChunkBuffer)
+
+func importExchangePayloadChunk(config *Config, chunk string) (bool, error) {
+
+	batchID, index, total, data, err := parseExchangeBatchChunk(chunk)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if len(data) > exchangeBatchChunkMaxDataSize {
+		return false, errors.TraceNew("chunk data too large")
+	}
+
+	encodedBatch, complete, err := bufferExchangeBatchChunk(batchID, index, total, data)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if !complete {
+		return false, nil
+	}
+
+	err = importExchangePayloadBatch(config, encodedBatch)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	return true, nil
+}
+
+func parseExchangeBatchChunk(chunk string) (batchID string, index int, total int, data string, err error) {
+
+	parts := strings.SplitN(chunk, ":", 4)
+	if len(parts) != 4 || parts[0] != exchangeBatchChunkPrefix {
+		return "", 0, 0, "", errors.TraceNew("invalid chunk format")
+	}
+
+	batchID = parts[1]
+
+	indexParts := strings.SplitN(parts[2], "/", 2)
+	if len(indexParts) != 2 {
+		return "", 0, 0, "", errors.TraceNew("invalid chunk index")
+	}
+
+	index, err = strconv.Atoi(indexParts[0])
+	if err != nil || index < 1 {
+		return "", 0, 0, "", errors.TraceNew("invalid chunk index")
+	}
+
+	total, err = strconv.Atoi(indexParts[1])
+	if err != nil || total < 1 || index > total {
+		return "", 0, 0, "", errors.TraceNew("invalid chunk total")
+	}
+
+	return batchID, index, total, parts[3], nil
+}
+
+// bufferExchangeBatchChunk records one chunk of a batch, keyed by batchID,
+// and reports the concatenated, still-encoded batch once every chunk from
+// 1 to total has been received.
+//
+// A chunk's total is checked against the total recorded for its batchID
+// when the first chunk arrived, and its index is checked against that same
+// total, before it's inserted: without this, a stray chunk -- carrying a
+// mismatched total, or an index beyond the batch's real chunk count --
+// would still count towards len(buffer.received), falsely completing the
+// batch one real chunk short and silently corrupting reconstruction, while
+// the genuine chunk arrives too late to matter.
+//
+// Since batchID, total, and each chunk's data all come from an untrusted
+// peer, potentially before any cryptographic check, bufferExchangeBatchChunk
+// also bounds the resources a flood of bogus or never-completed batches can
+// consume: expired pending batches are swept out on each call; a batch that
+// would exceed exchangeBatchMaxBufferedBytes is rejected outright; and a
+// chunk for a new batch ID is rejected once exchangeBatchMaxPendingBatches
+// distinct, incomplete batches are already buffered.
+func bufferExchangeBatchChunk(batchID string, index int, total int, data string) (string, bool, error) {
+
+	exchangeBatchChunksMutex.Lock()
+	defer exchangeBatchChunksMutex.Unlock()
+
+	sweepExchangeBatchChunksLocked()
+
+	buffer, ok := exchangeBatchChunks[batchID]
+	if !ok {
+		if len(exchangeBatchChunks) >= exchangeBatchMaxPendingBatches {
+			return "", false, errors.TraceNew("too many pending batches")
+		}
+		buffer = &exchangeBatchChunkBuffer{
+			total:     total,
+			received:  make(map[int]string),
+			createdAt: time.Now(),
+		}
+		exchangeBatchChunks[batchID] = buffer
+	}
+
+	if total != buffer.total || index > buffer.total {
+		return "", false, errors.TraceNew("inconsistent chunk total/index")
+	}
+
+	previous := len(buffer.received[index])
+	if buffer.bytesBuffered-previous+len(data) > exchangeBatchMaxBufferedBytes {
+		return "", false, errors.TraceNew("batch too large")
+	}
+	buffer.bytesBuffered += len(data) - previous
+
+	buffer.received[index] = data
+
+	if len(buffer.received) < buffer.total {
+		return "", false, nil
+	}
+
+	delete(exchangeBatchChunks, batchID)
+
+	var encodedBatch strings.Builder
+	for i := 1; i <= buffer.total; i++ {
+		encodedBatch.WriteString(buffer.received[i])
+	}
+
+	return encodedBatch.String(), true, nil
+}
+
+// sweepExchangeBatchChunksLocked removes pending batches older than
+// exchangeBatchPendingTTL. The caller must hold exchangeBatchChunksMutex.
+func sweepExchangeBatchChunksLocked() {
+
+	cutoff := time.Now().Add(-exchangeBatchPendingTTL)
+
+	for batchID, buffer := range exchangeBatchChunks {
+		if buffer.createdAt.Before(cutoff) {
+			delete(exchangeBatchChunks, batchID)
+		}
+	}
+}
+
+func importExchangePayloadBatch(config *Config, encodedBatch string) error {
+
+	networkID := config.GetNetworkID()
+
+	key, err := getExchangeObfuscationKey(config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	boxedBatch, err := decodeExchangeBytes(encodedBatch)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(boxedBatch) <= 24 {
+		return errors.TraceNew("unexpected box length")
+	}
+
+	secretboxNonce := boxedBatch[:24]
+	box := boxedBatch[24:]
+
+	// As with importExchangePayload, reject batches that have already been
+	// imported before attempting to decrypt them.
+	seen, err := checkAndInsertExchangeReplay(config, secretboxNonce, box)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if seen {
+		return errors.Trace(ErrExchangeReplay)
+	}
+
+	batchJSON, err := openSealedExchangeBox(key, secretboxNonce, box)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var batch exchangePayloadBatch
+	err = json.Unmarshal(batchJSON, &batch)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	promoted := false
+
+	for _, entry := range batch.Entries {
+
+		entry.ServerEntryFields.RemoveUnsignedFields()
+
+		err := entry.ServerEntryFields.VerifySignature(
+			config.ServerEntrySignaturePublicKey)
+		if err != nil {
+			NoticeWarning(
+				"ImportExchangePayloadChunk: skipping unverified server entry: %s",
+				errors.Trace(err))
+			continue
+		}
+
+		payload := &exchangePayload{
+			ServerEntryFields:       entry.ServerEntryFields,
+			ExchangedDialParameters: entry.ExchangedDialParameters,
+		}
+
+		err = importExchangePayloadContent(config, networkID, payload, !promoted)
+		if err != nil {
+			NoticeWarning(
+				"ImportExchangePayloadChunk: skipping server entry: %s",
+				errors.Trace(err))
+			continue
+		}
+
+		promoted = true
+	}
+
+	if !promoted {
+		return errors.TraceNew("no server entries imported")
+	}
+
+	return nil
+}
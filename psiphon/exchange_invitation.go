@@ -0,0 +1,379 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+// exchangeNtorProtoID binds the ntor-style key derivation below to this
+// specific handshake, preventing confusion with any other protocol that
+// might derive keys from a Curve25519 shared secret in a similar way.
+const exchangeNtorProtoID = "Psiphon-exchange-ntor-1"
+
+// exchangeInvitation is the plaintext content of an invitation generated by
+// NewExchangeInvitation. ID identifies this particular exchange and is
+// folded into the ntor-style key derivation; PublicKey is the importer's
+// ephemeral Curve25519 public key, conventionally "B" in ntor notation.
+type exchangeInvitation struct {
+	ID        []byte
+	PublicKey []byte
+}
+
+// exchangeInvitationSecret is the plaintext content of the secretHandle
+// returned alongside an invitation by NewExchangeInvitation. Unlike the
+// invitation itself, it is never transmitted to the exporter: the importer
+// retains it, in memory, for the lifetime of the exchange, and presents it
+// back to CompleteExchangeImport.
+type exchangeInvitationSecret struct {
+	ID         []byte
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+// NewExchangeInvitation begins an ephemeral, forward-secret exchange. It
+// generates a fresh Curve25519 keypair and returns an invitation -- which may
+// be published as a short code, for example rendered as a QR code or sent
+// over NFC, for a peer to complete with ExportExchangePayloadForInvitation
+// and CompleteExchangeImport -- and a secretHandle, which the caller must
+// retain for the lifetime of the exchange.
+//
+// As with ExportExchangePayload/ImportExchangePayload, the invitation and
+// the secretHandle are obfuscated with the ExchangeObfuscationKey embedded
+// in clients, so that casual tooling cannot enumerate outstanding
+// invitations. Unlike the long-lived ExchangeObfuscationKey, the ephemeral
+// keypair generated here is specific to this one exchange: compromise of a
+// single client -- or even of the ExchangeObfuscationKey itself -- does not
+// compromise the payload of any past or future exchange.
+//
+// The return values are the invitation and secretHandle; when both are "",
+// generation failed and a diagnostic notice has been logged.
+func NewExchangeInvitation(config *Config) (string, string) {
+	invitation, secretHandle, err := newExchangeInvitation(config)
+	if err != nil {
+		NoticeWarning("NewExchangeInvitation failed: %s", errors.Trace(err))
+		return "", ""
+	}
+	return invitation, secretHandle
+}
+
+func newExchangeInvitation(config *Config) (string, string, error) {
+
+	key, err := getExchangeObfuscationKey(config)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	publicKey, privateKey, err := generateExchangeKeyPair()
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	ID, err := common.MakeSecureRandomBytes(16)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	invitationPayload, err := json.Marshal(&exchangeInvitation{
+		ID:        ID,
+		PublicKey: publicKey,
+	})
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	invitation, err := sealExchangeBlob(key, invitationPayload)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	secretPayload, err := json.Marshal(&exchangeInvitationSecret{
+		ID:         ID,
+		PublicKey:  publicKey,
+		PrivateKey: privateKey,
+	})
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	secretHandle, err := sealExchangeBlob(key, secretPayload)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	return invitation, secretHandle, nil
+}
+
+// ExportExchangePayloadForInvitation completes the exporter's side of an
+// exchange begun by a peer's NewExchangeInvitation. Unlike
+// ExportExchangePayload, the resulting payload is sealed with a key derived
+// from a fresh, per-exchange ntor-style Curve25519 handshake against the
+// invitation, rather than with the long-lived ExchangeObfuscationKey: the
+// exporter generates its own ephemeral keypair (Y, y), computes
+// secret_input = EXP(B, y) | ID | B | Y | PROTOID, and derives both a
+// secretbox key and a MAC binding Y to the invitation from secret_input.
+//
+// The return value is a payload that may be passed to
+// CompleteExchangeImport; when "", the export failed and a diagnostic
+// notice has been logged.
+func ExportExchangePayloadForInvitation(config *Config, invitation string) string {
+	payload, err := exportExchangePayloadForInvitation(config, invitation)
+	if err != nil {
+		NoticeWarning("ExportExchangePayloadForInvitation failed: %s", errors.Trace(err))
+		return ""
+	}
+	return payload
+}
+
+// CompleteExchangeImport completes an exchange begun with
+// NewExchangeInvitation. secretHandle is the value returned alongside the
+// invitation, and encodedPayload is the response produced by the exporter's
+// ExportExchangePayloadForInvitation call made against that invitation.
+//
+// As with ImportExchangePayload, a response that has already been presented
+// for import once, within the replay filter's retention window, is rejected with
+// ExchangeReplayError; CompleteExchangeImport returns this error, rather
+// than only logging it, so that a host app can distinguish it from a
+// decrypt or verification failure.
+//
+// The first return value indicates a successful import. If the import
+// failed, the error is also returned, in addition to a diagnostic notice
+// having been logged.
+func CompleteExchangeImport(config *Config, secretHandle string, encodedPayload string) (bool, error) {
+	err := completeExchangeImport(config, secretHandle, encodedPayload)
+	if err != nil {
+		NoticeWarning("CompleteExchangeImport failed: %s", errors.Trace(err))
+		return false, errors.Trace(err)
+	}
+	return true, nil
+}
+
+func exportExchangePayloadForInvitation(config *Config, invitation string) (string, error) {
+
+	networkID := config.GetNetworkID()
+
+	key, err := getExchangeObfuscationKey(config)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	invitationPayload, err := openExchangeBlob(key, invitation)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var invite exchangeInvitation
+	err = json.Unmarshal(invitationPayload, &invite)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	payload, err := makeExchangePayload(networkID)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	exporterPublicKey, exporterPrivateKey, err := generateExchangeKeyPair()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	sharedSecret, err := exchangeScalarMult(exporterPrivateKey, invite.PublicKey)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	secretboxKey, mac := deriveExchangeNtorKeys(
+		sharedSecret, invite.ID, invite.PublicKey, exporterPublicKey)
+
+	nonce, err := common.MakeSecureRandomBytes(24)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var secretboxNonce [24]byte
+	copy(secretboxNonce[:], nonce)
+
+	boxedPayload := secretboxSeal(payloadJSON, &secretboxNonce, &secretboxKey)
+
+	response := make([]byte, 0, len(exporterPublicKey)+len(secretboxNonce)+len(boxedPayload)+len(mac))
+	response = append(response, exporterPublicKey...)
+	response = append(response, secretboxNonce[:]...)
+	response = append(response, boxedPayload...)
+	response = append(response, mac...)
+
+	return encodeExchangeBytes(response), nil
+}
+
+func completeExchangeImport(config *Config, secretHandle string, encodedPayload string) error {
+
+	networkID := config.GetNetworkID()
+
+	key, err := getExchangeObfuscationKey(config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	secretPayload, err := openExchangeBlob(key, secretHandle)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var secret exchangeInvitationSecret
+	err = json.Unmarshal(secretPayload, &secret)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	response, err := decodeExchangeBytes(encodedPayload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	const publicKeyLength = 32
+	const nonceLength = 24
+	const macLength = sha256.Size
+
+	if len(response) <= publicKeyLength+nonceLength+macLength {
+		return errors.TraceNew("unexpected response length")
+	}
+
+	exporterPublicKey := response[:publicKeyLength]
+	nonce := response[publicKeyLength : publicKeyLength+nonceLength]
+	boxedPayload := response[publicKeyLength+nonceLength : len(response)-macLength]
+	mac := response[len(response)-macLength:]
+
+	// As with importExchangePayload, reject payloads that have already been
+	// imported before doing any cryptographic work, so a flood of replayed
+	// payloads is cheap to reject -- this check must come before the
+	// Curve25519 scalar multiplication and MACs below.
+	seen, err := checkAndInsertExchangeReplay(config, nonce, boxedPayload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if seen {
+		return errors.Trace(ErrExchangeReplay)
+	}
+
+	sharedSecret, err := exchangeScalarMult(secret.PrivateKey, exporterPublicKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	secretboxKey, expectedMAC := deriveExchangeNtorKeys(
+		sharedSecret, secret.ID, secret.PublicKey, exporterPublicKey)
+
+	if subtle.ConstantTimeCompare(mac, expectedMAC) != 1 {
+		return errors.TraceNew("invalid exchange authenticator")
+	}
+
+	var secretboxNonce [24]byte
+	copy(secretboxNonce[:], nonce)
+
+	payloadJSON, ok := secretboxOpen(boxedPayload, &secretboxNonce, &secretboxKey)
+	if !ok {
+		return errors.TraceNew("unbox failed")
+	}
+
+	var payload *exchangePayload
+	err = json.Unmarshal(payloadJSON, &payload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return importExchangePayloadContent(config, networkID, payload, true)
+}
+
+// generateExchangeKeyPair generates an ephemeral Curve25519 keypair for use
+// in a single exchange.
+func generateExchangeKeyPair() (publicKey []byte, privateKey []byte, err error) {
+
+	random, err := common.MakeSecureRandomBytes(32)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	var priv, pub [32]byte
+	copy(priv[:], random)
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	return pub[:], priv[:], nil
+}
+
+// exchangeScalarMult computes the Curve25519 shared secret and rejects the
+// low-order-point case, where curve25519.ScalarMult sets shared to all
+// zeroes regardless of the private scalar: since publicKey always comes
+// from a peer -- in an invitation, sealed only with the long-lived,
+// widely-shared ExchangeObfuscationKey, or in a response, where it is not
+// sealed at all -- rather than under any per-exchange secret, anyone who
+// has extracted that key from a client binary, or who can alter a response
+// in transit, can forge a low-order public key and force a known
+// sharedSecret, recovering the
+// session key without either party's ephemeral private scalar. Rejecting
+// the all-zero result, as curve25519.X25519 itself does, closes that off.
+func exchangeScalarMult(privateKey []byte, publicKey []byte) ([]byte, error) {
+	if len(privateKey) != 32 || len(publicKey) != 32 {
+		return nil, errors.TraceNew("invalid key length")
+	}
+	var priv, pub, shared [32]byte
+	copy(priv[:], privateKey)
+	copy(pub[:], publicKey)
+	curve25519.ScalarMult(&shared, &priv, &pub)
+	var zero [32]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, errors.TraceNew("invalid (low-order) exchange public key")
+	}
+	return shared[:], nil
+}
+
+// deriveExchangeNtorKeys implements the ntor-style key derivation:
+// secret_input = sharedSecret | ID | B | Y | PROTOID, hashed with distinct
+// HMAC-SHA256 "key"/"mac" tags to derive a secretbox key and a MAC that
+// binds the exporter's ephemeral public key Y to the invitation (ID, B).
+func deriveExchangeNtorKeys(sharedSecret, ID, B, Y []byte) (secretboxKey [32]byte, mac []byte) {
+
+	secretInput := make([]byte, 0, len(sharedSecret)+len(ID)+len(B)+len(Y)+len(exchangeNtorProtoID))
+	secretInput = append(secretInput, sharedSecret...)
+	secretInput = append(secretInput, ID...)
+	secretInput = append(secretInput, B...)
+	secretInput = append(secretInput, Y...)
+	secretInput = append(secretInput, []byte(exchangeNtorProtoID)...)
+
+	keyHMAC := hmac.New(sha256.New, []byte(exchangeNtorProtoID+":key"))
+	keyHMAC.Write(secretInput)
+	copy(secretboxKey[:], keyHMAC.Sum(nil))
+
+	macHMAC := hmac.New(sha256.New, []byte(exchangeNtorProtoID+":mac"))
+	macHMAC.Write(secretInput)
+	mac = macHMAC.Sum(nil)
+
+	return secretboxKey, mac
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/dchest/siphash"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	exchangeReplayFilterFilename      = "exchange_replay.bolt"
+	exchangeReplayFilterBucket        = "exchangeReplayDigests"
+	exchangeReplayFilterKeyBucket     = "exchangeReplayFilterKey"
+	exchangeReplayFilterKeyRecord     = "siphashKey"
+	exchangeReplayFilterMaxEntries    = 100000
+	exchangeReplayFilterWindow        = 30 * 24 * time.Hour
+	exchangeReplayFilterSweepInterval = 1 * time.Hour
+	exchangeReplayDigestPrefixLength  = 64
+)
+
+// ExchangeReplayError indicates that an exchange payload presented to
+// importExchangePayload or completeExchangeImport has already been presented
+// for import once before, within the replay filter's retention window,
+// whether or not that earlier attempt succeeded. Callers can
+// distinguish this from a decrypt or verification failure by checking for
+// this type.
+type ExchangeReplayError struct{}
+
+func (ExchangeReplayError) Error() string {
+	return "exchange payload already imported"
+}
+
+// ErrExchangeReplay is the distinguished error value returned, wrapped, when
+// an exchange payload is rejected as a replay.
+var ErrExchangeReplay error = ExchangeReplayError{}
+
+var exchangeReplayFilterMutex sync.Mutex
+var exchangeReplayFilterDB *bbolt.DB
+var exchangeReplayFilterSipHashKey []byte
+var exchangeReplayFilterStop chan struct{}
+
+// checkAndInsertExchangeReplay reports whether the exchange payload
+// identified by (secretboxNonce, boxedPayload) has been seen before, within
+// the replay filter's retention window, and otherwise records it as seen.
+// The check and insert are performed atomically, so two concurrent imports
+// of the same payload cannot both be accepted.
+//
+// The filter is a bounded, persistent hash set backed by BoltDB, keyed on a
+// SipHash-2-4 digest -- keyed with a per-install random key stored once in
+// the datastore -- of the nonce and a prefix of the boxed (still encrypted)
+// payload, so the filter can reject replays without needing to decrypt the
+// payload first.
+func checkAndInsertExchangeReplay(
+	config *Config, secretboxNonce []byte, boxedPayload []byte) (bool, error) {
+
+	db, sipHashKey, err := openExchangeReplayFilter(config)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	digest := exchangeReplayDigest(sipHashKey, secretboxNonce, boxedPayload)
+
+	now := time.Now()
+	seen := false
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+
+		bucket := tx.Bucket([]byte(exchangeReplayFilterBucket))
+
+		if bucket.Get(digest[:]) != nil {
+			seen = true
+			return nil
+		}
+
+		var value [8]byte
+		binary.BigEndian.PutUint64(value[:], uint64(now.Unix()))
+
+		return bucket.Put(digest[:], value[:])
+	})
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	return seen, nil
+}
+
+// openExchangeReplayFilter lazily opens, or returns the already-open handle
+// to, the replay filter's BoltDB file. The filter stays open, and its sweep
+// goroutine keeps running, until CloseExchangeReplayFilter is called; that
+// should happen wherever the embedding app already closes the rest of the
+// datastore, since, like the datastore, the replay filter is opened again
+// on next use.
+func openExchangeReplayFilter(config *Config) (*bbolt.DB, []byte, error) {
+
+	exchangeReplayFilterMutex.Lock()
+	defer exchangeReplayFilterMutex.Unlock()
+
+	if exchangeReplayFilterDB != nil {
+		return exchangeReplayFilterDB, exchangeReplayFilterSipHashKey, nil
+	}
+
+	path := filepath.Join(config.DataStoreDirectory, exchangeReplayFilterFilename)
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	var sipHashKey []byte
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+
+		_, err := tx.CreateBucketIfNotExists([]byte(exchangeReplayFilterBucket))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		keyBucket, err := tx.CreateBucketIfNotExists([]byte(exchangeReplayFilterKeyBucket))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		sipHashKey = keyBucket.Get([]byte(exchangeReplayFilterKeyRecord))
+		if sipHashKey == nil {
+			sipHashKey, err = common.MakeSecureRandomBytes(16)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			err = keyBucket.Put([]byte(exchangeReplayFilterKeyRecord), sipHashKey)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, nil, errors.Trace(err)
+	}
+
+	stop := make(chan struct{})
+
+	exchangeReplayFilterDB = db
+	exchangeReplayFilterSipHashKey = sipHashKey
+	exchangeReplayFilterStop = stop
+
+	go sweepExchangeReplayFilter(db, stop)
+
+	return db, sipHashKey, nil
+}
+
+// CloseExchangeReplayFilter closes the replay filter's BoltDB handle and
+// stops its background expiry sweep goroutine, if the filter has been
+// opened. This must be called as part of the same shutdown sequence that
+// closes the rest of the datastore: the filter is opened lazily, on first
+// use, in the same process that may start and stop the tunnel many times,
+// so, without this, each restart leaks one goroutine and one open file
+// handle. It is safe to call even if the filter was never opened.
+func CloseExchangeReplayFilter() {
+
+	exchangeReplayFilterMutex.Lock()
+	defer exchangeReplayFilterMutex.Unlock()
+
+	if exchangeReplayFilterDB == nil {
+		return
+	}
+
+	close(exchangeReplayFilterStop)
+	exchangeReplayFilterDB.Close()
+
+	exchangeReplayFilterDB = nil
+	exchangeReplayFilterSipHashKey = nil
+	exchangeReplayFilterStop = nil
+}
+
+func exchangeReplayDigest(sipHashKey, secretboxNonce, boxedPayload []byte) [8]byte {
+
+	k0 := binary.LittleEndian.Uint64(sipHashKey[0:8])
+	k1 := binary.LittleEndian.Uint64(sipHashKey[8:16])
+
+	prefixLength := exchangeReplayDigestPrefixLength
+	if prefixLength > len(boxedPayload) {
+		prefixLength = len(boxedPayload)
+	}
+
+	data := make([]byte, 0, len(secretboxNonce)+prefixLength)
+	data = append(data, secretboxNonce...)
+	data = append(data, boxedPayload[:prefixLength]...)
+
+	var digest [8]byte
+	binary.BigEndian.PutUint64(digest[:], siphash.Hash(k0, k1, data))
+	return digest
+}
+
+// sweepExchangeReplayFilter periodically removes digests older than
+// exchangeReplayFilterWindow, and, if the filter has still grown beyond
+// exchangeReplayFilterMaxEntries, evicts the oldest remaining entries --
+// approximating LRU eviction -- so the filter cannot grow unbounded. It
+// runs until stop is closed by CloseExchangeReplayFilter.
+func sweepExchangeReplayFilter(db *bbolt.DB, stop chan struct{}) {
+
+	ticker := time.NewTicker(exchangeReplayFilterSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-exchangeReplayFilterWindow).Unix()
+
+		_ = db.Update(func(tx *bbolt.Tx) error {
+
+			bucket := tx.Bucket([]byte(exchangeReplayFilterBucket))
+
+			type entry struct {
+				key       []byte
+				timestamp int64
+			}
+
+			var entries []entry
+
+			c := bucket.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if len(v) != 8 {
+					continue
+				}
+				entries = append(entries, entry{
+					key:       append([]byte{}, k...),
+					timestamp: int64(binary.BigEndian.Uint64(v)),
+				})
+			}
+
+			for _, e := range entries {
+				if e.timestamp < cutoff {
+					if err := bucket.Delete(e.key); err != nil {
+						return errors.Trace(err)
+					}
+				}
+			}
+
+			remaining := bucket.Stats().KeyN
+			if remaining <= exchangeReplayFilterMaxEntries {
+				return nil
+			}
+
+			entries = entries[:0]
+			c = bucket.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if len(v) != 8 {
+					continue
+				}
+				entries = append(entries, entry{
+					key:       append([]byte{}, k...),
+					timestamp: int64(binary.BigEndian.Uint64(v)),
+				})
+			}
+
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].timestamp < entries[j].timestamp
+			})
+
+			excess := len(entries) - exchangeReplayFilterMaxEntries
+			for i := 0; i < excess; i++ {
+				if err := bucket.Delete(entries[i].key); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		})
+	}
+}
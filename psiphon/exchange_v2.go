@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/golang/protobuf/proto"
+)
+
+// exchangePayloadMagicProtobufV2 is prepended to the plaintext of a sealed
+// exchange payload to distinguish the versioned protobuf encoding,
+// implemented in this file, from the original, unversioned JSON encoding of
+// exchangePayload. This byte cannot be confused with legacy plaintext, which
+// always begins with the JSON object delimiter '{' (0x7b).
+const exchangePayloadMagicProtobufV2 = byte(0x01)
+
+// exchangePayloadReaderVersion is the highest ExchangePayloadV2 version this
+// client understands, and is used both as the Version and as a lower bound
+// against a peer's MinReaderVersion: if a received payload's
+// MinReaderVersion exceeds exchangePayloadReaderVersion, this client is too
+// old to safely use the exchanged dial parameters and falls back to a
+// server-entry-only import.
+const exchangePayloadReaderVersion = 2
+
+// encodeExchangePayloadV2 marshals payload as a versioned ExchangePayloadV2
+// protobuf message, prefixed with exchangePayloadMagicProtobufV2, ready to
+// be sealed by sealExchangeBlob. As documented on ExchangePayloadV2 itself,
+// it is only the envelope that is versioned this way: ServerEntryFields and
+// ExchangedDialParameters are still JSON-encoded into the message's opaque
+// bytes fields, unchanged from before this format existed.
+func encodeExchangePayloadV2(payload *exchangePayload) ([]byte, error) {
+
+	serverEntryFieldsJSON, err := json.Marshal(payload.ServerEntryFields)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var dialParametersJSON []byte
+	if payload.ExchangedDialParameters != nil {
+		dialParametersJSON, err = json.Marshal(payload.ExchangedDialParameters)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	pb := &protocol.ExchangePayloadV2{
+		Version:                 exchangePayloadReaderVersion,
+		MinReaderVersion:        exchangePayloadReaderVersion,
+		ServerEntries:           [][]byte{serverEntryFieldsJSON},
+		ExchangedDialParameters: [][]byte{dialParametersJSON},
+	}
+
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return append([]byte{exchangePayloadMagicProtobufV2}, data...), nil
+}
+
+// decodeExchangePayloadV2 reverses encodeExchangePayloadV2, given the
+// plaintext with the magic prefix already stripped. Dial parameters are
+// dropped, and only the server entry is returned, whenever this reader
+// cannot be sure it is safe to use them: either because the payload's own
+// Version is newer than this client's exchangePayloadReaderVersion -- this
+// reader does not recognize the format well enough to trust any field it
+// does not already know about -- or because the payload's MinReaderVersion
+// says so explicitly. Either way, an older client can still benefit from a
+// server-entry-only import.
+func decodeExchangePayloadV2(data []byte) (*exchangePayload, error) {
+
+	var pb protocol.ExchangePayloadV2
+	err := proto.Unmarshal(data, &pb)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(pb.ServerEntries) == 0 {
+		return nil, errors.TraceNew("no server entries in payload")
+	}
+
+	var serverEntryFields protocol.ServerEntryFields
+	err = json.Unmarshal(pb.ServerEntries[0], &serverEntryFields)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var exchangedDialParameters *ExchangedDialParameters
+	if pb.Version <= exchangePayloadReaderVersion &&
+		pb.MinReaderVersion <= exchangePayloadReaderVersion &&
+		len(pb.ExchangedDialParameters) > 0 && len(pb.ExchangedDialParameters[0]) > 0 {
+
+		err = json.Unmarshal(pb.ExchangedDialParameters[0], &exchangedDialParameters)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return &exchangePayload{
+		ServerEntryFields:       serverEntryFields,
+		ExchangedDialParameters: exchangedDialParameters,
+	}, nil
+}
+
+// decodeExchangePayload sniffs the one-byte magic prefix of a decrypted
+// exchange payload and dispatches to the versioned protobuf decoder or,
+// for payloads exported before this format existed, the original JSON
+// decoder.
+func decodeExchangePayload(plaintext []byte) (*exchangePayload, error) {
+
+	if len(plaintext) > 0 && plaintext[0] == exchangePayloadMagicProtobufV2 {
+		return decodeExchangePayloadV2(plaintext[1:])
+	}
+
+	var payload *exchangePayload
+	err := json.Unmarshal(plaintext, &payload)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return payload, nil
+}